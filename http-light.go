@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,88 +11,155 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, 4096)
-	},
-}
+const (
+	// defaultIdleTimeout bounds how long a keep-alive connection may sit
+	// between requests before it is reaped.
+	defaultIdleTimeout = 90 * time.Second
+	// defaultReadTimeout bounds how long reading a single request (line,
+	// headers, and body) may take.
+	defaultReadTimeout = 10 * time.Second
+	// defaultWriteTimeout bounds how long writing a single response may take.
+	defaultWriteTimeout = 10 * time.Second
+)
+
+// defaultMaxRequestBodyBytes is the value NewServer gives Server.MaxRequestBodyBytes;
+// callers that need a different limit can tune it per Server from there.
+const defaultMaxRequestBodyBytes int64 = 10 << 20 // 10 MiB
+
+// errBodyTooLarge is returned by parseRequest when a request's body exceeds
+// Server.MaxRequestBodyBytes, either because Content-Length said so up front
+// or because a chunked body ran past the limit while being read.
+var errBodyTooLarge = errors.New("request body too large")
 
 func main() {
-	// Create a TCP listener
-	listener, err := net.Listen("tcp", ":8080")
-	if err != nil {
+	server := NewServer(":8080")
+	log.Println("Listening on :8080")
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Error starting TCP listener: %v", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
-
-	log.Println("Listening on :8080")
-
-	for {
-		// Accept a new connection
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue
-		}
-
-		// Handle the connection concurrently
-		go handleConnection(conn)
-	}
 }
 
 type Request struct {
 	Method  string
 	URL     string
+	Proto   string
 	Headers map[string]string
-	Body    string
+	Body    io.ReadCloser
+	Params  map[string]string
 }
 
-type Response struct {
-	StatusCode int
-	Headers    map[string]string
-	Body       string
+// ResponseWriter is implemented by anything a handler can write an HTTP
+// response to: connResponseWriter, used while serving real connections, and
+// ResponseRecorder, used to unit test handlers without a socket. It mirrors
+// the shape of the stdlib's net/http.ResponseWriter, with a plain
+// map[string]string in place of http.Header.
+type ResponseWriter interface {
+	// Header returns the map that becomes the response's headers; callers
+	// mutate it before calling WriteHeader or Write.
+	Header() map[string]string
+	// WriteHeader sends the status line and headers. Calling it more than
+	// once is a no-op. If a handler never calls it, the first Write (or the
+	// handler returning without writing anything) implies WriteHeader(200).
+	WriteHeader(statusCode int)
+	// Write writes body bytes, implicitly calling WriteHeader(200) first if
+	// it hasn't been called yet.
+	Write(p []byte) (int, error)
 }
 
-func handleConnection(conn net.Conn) {
+// handleConnection serves requests off conn until the connection is closed,
+// either because a request or response asked for it (HTTP/1.0 semantics, or
+// an explicit "Connection: close"), because a timeout elapses, or because
+// the client goes away. Requests are read off a single bufio.Reader so
+// pipelined requests queued back-to-back by the client are all served.
+//
+// Two different read deadlines apply: defaultIdleTimeout bounds how long the
+// connection may sit with no request in flight, and defaultReadTimeout — set
+// once the first byte of a new request has arrived — bounds how long reading
+// the rest of that request (headers and body) may take, so a client that
+// starts a request and then trickles it in slowly can't hold the connection
+// open indefinitely.
+func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	log.Printf("Accepted connection from %v", conn.RemoteAddr())
 
-	// Parse the HTTP request
-	req, err := parseRequest(conn)
-	if err != nil {
-		log.Printf("Error parsing request: %v", err)
-		writeErrorResponse(conn, 400, "Bad Request")
-		return
-	}
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(defaultReadTimeout))
 
-	// Generate a response
-	res := handleRequest(req)
+		req, err := s.parseRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			log.Printf("Error parsing request: %v", err)
+			if errors.Is(err, errBodyTooLarge) {
+				writeErrorResponse(conn, 413, "Payload Too Large")
+			} else {
+				writeErrorResponse(conn, 400, "Bad Request")
+			}
+			return
+		}
 
-	// Write the response
-	err = writeResponse(conn, res)
-	if err != nil {
-		log.Printf("Error writing response: %v", err)
+		w := newConnResponseWriter(conn)
+		conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+		if s.Handler != nil {
+			s.Handler(w, req)
+		} else {
+			router.ServeRequest(w, req)
+		}
+		if err := w.finish(); err != nil {
+			log.Printf("Error writing response: %v", err)
+			return
+		}
+
+		// A handler that doesn't read req.Body (or reads only part of it)
+		// would otherwise leave its bytes sitting in the shared reader,
+		// corrupting the parse of the next pipelined/keep-alive request.
+		if err := drainBody(req.Body); err != nil {
+			log.Printf("Error draining request body: %v", err)
+			return
+		}
+
+		if !keepAlive(req, w.headers) {
+			return
+		}
 	}
 }
 
-func parseRequest(conn net.Conn) (*Request, error) {
-	reader := bufio.NewReader(conn)
+// drainBody discards any unread request body bytes and closes body, so the
+// shared reader is left positioned at the start of the next request.
+func drainBody(body io.ReadCloser) error {
+	defer body.Close()
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
+// parseRequest reads a single HTTP request off reader. Because reader is a
+// *bufio.Reader shared across the lifetime of the connection, any bytes left
+// buffered after this request (e.g. a pipelined follow-up request) are
+// preserved for the next call. The returned Request's Body may be read
+// lazily off reader; it must be read to its end (closing it does not skip
+// the unread bytes) before the next pipelined request can be parsed.
+func (s *Server) parseRequest(reader *bufio.Reader) (*Request, error) {
 	requestLine, err := reader.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
 
-	parts := strings.Split(strings.TrimSpace(requestLine), " ")
+	parts := strings.SplitN(strings.TrimSpace(requestLine), " ", 3)
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("malformed request line")
 	}
-
-	method := parts[0]
-	url := parts[1]
+	method, url, proto := parts[0], parts[1], parts[2]
 
 	headers := make(map[string]string)
 	for {
@@ -102,112 +171,308 @@ func parseRequest(conn net.Conn) (*Request, error) {
 		if line == "" {
 			break
 		}
-		headerParts := strings.SplitN(line, ": ", 2)
-		if len(headerParts) != 2 {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
 			return nil, fmt.Errorf("malformed header line")
 		}
-		headers[headerParts[0]] = headerParts[1]
+		key := strings.TrimSpace(line[:colon])
+		value := strings.TrimSpace(line[colon+1:])
+		headers[key] = value
 	}
 
-	var body string
-	if contentLength, ok := headers["Content-Length"]; ok {
-		length, err := strconv.Atoi(contentLength)
-		if err != nil {
-			return nil, fmt.Errorf("invalid Content-Length")
-		}
-		bodyBuffer := bufferPool.Get().([]byte)
-		defer bufferPool.Put(bodyBuffer)
-		bodyBytes := bodyBuffer[:length]
-		_, err = io.ReadFull(reader, bodyBytes)
-		if err != nil {
-			return nil, err
-		}
-		body = string(bodyBytes)
+	body, err := s.readBody(reader, headers)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Request{
 		Method:  method,
 		URL:     url,
+		Proto:   proto,
 		Headers: headers,
 		Body:    body,
 	}, nil
 }
 
-func handleRequest(req *Request) *Response {
-	switch req.URL {
-	case "/":
-		return handleRoot(req)
-	case "/hello":
-		return handleHello(req)
-	default:
-		return &Response{
-			StatusCode: 404,
-			Headers: map[string]string{
-				"Content-Type": "text/plain",
-			},
-			Body: "404 Not Found",
+// readBody builds the io.ReadCloser a handler will read the request body
+// from, according to the framing the headers describe: chunked
+// transfer-encoding takes priority over Content-Length, as in the stdlib.
+// Either way, a body over s.MaxRequestBodyBytes is rejected with
+// errBodyTooLarge before the handler runs, so callers see a clean 413
+// instead of a response that's already underway. Content-Length says its
+// size up front, so that case just checks the header; chunked doesn't, so
+// its body is read in full here (bounded by the limit) to get the same
+// up-front behavior.
+func (s *Server) readBody(reader *bufio.Reader, headers map[string]string) (io.ReadCloser, error) {
+	if strings.EqualFold(headers["Transfer-Encoding"], "chunked") {
+		data, err := readLimited(&chunkedReader{r: reader}, s.MaxRequestBodyBytes)
+		if err != nil {
+			return nil, err
 		}
+		return &body{Reader: bytes.NewReader(data)}, nil
+	}
+
+	contentLength, ok := headers["Content-Length"]
+	if !ok {
+		return &body{Reader: bytes.NewReader(nil)}, nil
 	}
+
+	length, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length")
+	}
+	if length > s.MaxRequestBodyBytes {
+		return nil, errBodyTooLarge
+	}
+
+	return &body{Reader: io.LimitReader(reader, length)}, nil
 }
 
-func handleRoot(req *Request) *Response {
-	return &Response{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "text/plain",
-		},
-		Body: "Welcome to the root page!",
+// readLimited fully reads r, failing with errBodyTooLarge if it produces
+// more than max bytes. r is capped at max+1 bytes so an oversized body
+// can't be read into memory in full before being rejected.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
 	}
+	if int64(len(data)) > max {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
 }
 
-func handleHello(req *Request) *Response {
-	name := req.Headers["Name"]
-	if name == "" {
-		name = "World"
+// body adapts an io.Reader into the io.ReadCloser exposed as Request.Body.
+// Closing it is a no-op: the underlying reader is either the connection's
+// shared bufio.Reader, which outlives any single request, or an in-memory
+// bytes.Reader.
+type body struct {
+	io.Reader
+}
+
+func (body) Close() error { return nil }
+
+// chunkedReader decodes a Transfer-Encoding: chunked body lazily, one chunk
+// at a time: "size\r\n", then size bytes, then "\r\n", terminating on a
+// zero-size chunk followed by optional trailers and a blank line.
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64 // bytes left in the chunk currently being read
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
 	}
-	return &Response{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "text/plain",
-		},
-		Body: fmt.Sprintf("Hello, %s!", name),
+	if c.remaining == 0 {
+		size, err := c.nextChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			if err := discardTrailers(c.r); err != nil {
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == nil && c.remaining == 0 {
+		if _, derr := c.r.Discard(2); derr != nil { // trailing CRLF
+			return n, derr
+		}
 	}
+	return n, err
 }
 
-func writeResponse(conn net.Conn, res *Response) error {
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", res.StatusCode, statusText(res.StatusCode))
-	_, err := conn.Write([]byte(statusLine))
+func (c *chunkedReader) nextChunkSize() (int64, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSpace(line)
+	if idx := strings.IndexByte(line, ';'); idx >= 0 {
+		line = line[:idx] // drop chunk extensions
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("invalid chunk size: %w", err)
 	}
+	return size, nil
+}
 
-	for key, value := range res.Headers {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := conn.Write([]byte(headerLine))
+// discardTrailers reads and discards trailer header lines up to the blank
+// line that ends a chunked body.
+func discardTrailers(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
 		if err != nil {
 			return err
 		}
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
 	}
+}
 
-	_, err = conn.Write([]byte("\r\n"))
+// keepAlive reports whether the connection should stay open for another
+// request, per HTTP/1.1 semantics (keep-alive unless either side asked to
+// close) and HTTP/1.0 semantics (close unless the request asked to keep
+// alive).
+func keepAlive(req *Request, resHeaders map[string]string) bool {
+	if strings.EqualFold(req.Headers["Connection"], "close") ||
+		strings.EqualFold(resHeaders["Connection"], "close") {
+		return false
+	}
+	if req.Proto == "HTTP/1.0" {
+		return strings.EqualFold(req.Headers["Connection"], "keep-alive")
+	}
+	return true
+}
+
+// router holds the server's routes. It is populated by newRouter during
+// package init so both the real connection loop and tests dispatch through
+// the same routing table.
+var router = newRouter()
+
+func newRouter() *Router {
+	r := NewRouter()
+	r.Handle("GET", "/", handleRoot)
+	r.Handle("GET", "/hello", handleHello)
+	return r
+}
+
+func handleRoot(w ResponseWriter, req *Request) {
+	body := []byte("Welcome to the root page!")
+	w.Header()["Content-Type"] = "text/plain"
+	w.Header()["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(200)
+	w.Write(body)
+}
+
+func handleHello(w ResponseWriter, req *Request) {
+	name := req.Headers["Name"]
+	if name == "" {
+		name = "World"
+	}
+	body := []byte(fmt.Sprintf("Hello, %s!", name))
+	w.Header()["Content-Type"] = "text/plain"
+	w.Header()["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(200)
+	w.Write(body)
+}
+
+// connResponseWriter is the ResponseWriter a real client connection is
+// served through. It writes the status line and headers on the first
+// WriteHeader or Write call, then streams the body, framing it with
+// Transfer-Encoding: chunked unless Content-Length was set ahead of time.
+type connResponseWriter struct {
+	conn        net.Conn
+	headers     map[string]string
+	statusCode  int
+	wroteHeader bool
+	chunked     bool
+	err         error
+}
+
+func newConnResponseWriter(conn net.Conn) *connResponseWriter {
+	return &connResponseWriter{conn: conn, headers: make(map[string]string), statusCode: 200}
+}
+
+func (w *connResponseWriter) Header() map[string]string { return w.headers }
+
+func (w *connResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+	w.chunked = w.headers["Content-Length"] == ""
+
+	w.recordErr(fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", statusCode, statusText(statusCode)))
+	for key, value := range w.headers {
+		w.recordErr(fmt.Fprintf(w.conn, "%s: %s\r\n", key, value))
+	}
+	if w.chunked {
+		w.recordErr(w.conn.Write([]byte("Transfer-Encoding: chunked\r\n")))
+	}
+	w.recordErr(w.conn.Write([]byte("\r\n")))
+}
+
+func (w *connResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.chunked {
+		return w.writeChunk(p)
+	}
+	n, err := w.conn.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// writeChunk frames p as a single Transfer-Encoding: chunked chunk.
+func (w *connResponseWriter) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(w.conn, "%x\r\n", len(p)); err != nil {
+		w.err = err
+		return 0, err
+	}
+	n, err := w.conn.Write(p)
 	if err != nil {
-		return err
+		w.err = err
+		return n, err
+	}
+	if _, err := w.conn.Write([]byte("\r\n")); err != nil {
+		w.err = err
+		return n, err
 	}
+	return n, nil
+}
 
-	_, err = conn.Write([]byte(res.Body))
-	return err
+// finish flushes a response whose handler never called WriteHeader or
+// Write (sending an empty 200), and terminates a chunked body with its
+// closing zero-size chunk.
+func (w *connResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(w.statusCode)
+	}
+	if w.chunked && w.err == nil {
+		if _, err := w.conn.Write([]byte("0\r\n\r\n")); err != nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+func (w *connResponseWriter) recordErr(_ int, err error) {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
 }
 
 func writeErrorResponse(conn net.Conn, statusCode int, message string) {
-	res := &Response{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "text/plain",
-		},
-		Body: message,
-	}
-	err := writeResponse(conn, res)
-	if err != nil {
+	w := newConnResponseWriter(conn)
+	w.Header()["Content-Type"] = "text/plain"
+	w.Header()["Content-Length"] = strconv.Itoa(len(message))
+	w.WriteHeader(statusCode)
+	w.Write([]byte(message))
+	if err := w.finish(); err != nil {
 		log.Printf("Error writing error response: %v", err)
 	}
 }
@@ -220,6 +485,10 @@ func statusText(statusCode int) string {
 		return "Bad Request"
 	case 404:
 		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 413:
+		return "Payload Too Large"
 	case 500:
 		return "Internal Server Error"
 	default:
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
@@ -11,8 +13,9 @@ import (
 
 func TestParseRequest(t *testing.T) {
 	requestString := "GET /hello HTTP/1.1\r\nHost: localhost\r\nName: Go\r\n\r\n"
-	conn := &mockConn{reader: strings.NewReader(requestString)}
-	req, err := parseRequest(conn)
+	reader := bufio.NewReader(strings.NewReader(requestString))
+	srv := NewServer("")
+	req, err := srv.parseRequest(reader)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -26,18 +29,50 @@ func TestParseRequest(t *testing.T) {
 	}
 }
 
-func TestWriteResponse(t *testing.T) {
-	conn := &mockConn{writer: &strings.Builder{}}
-	res := &Response{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type": "text/plain",
-		},
-		Body: "Hello, Go!",
+// TestReadBodyChunkedRespectsMaxRequestBodyBytes guards against a regression
+// where the chunked and Content-Length paths disagreed about whether a body
+// of exactly MaxRequestBodyBytes fits, and where an over-limit chunked body
+// only failed once a handler read it (too late for a clean 413) instead of
+// up front like the Content-Length path.
+func TestReadBodyChunkedRespectsMaxRequestBodyBytes(t *testing.T) {
+	srv := NewServer("")
+	srv.MaxRequestBodyBytes = 4
+
+	reader := bufio.NewReader(strings.NewReader("4\r\nabcd\r\n0\r\n\r\n"))
+	body, err := srv.readBody(reader, map[string]string{"Transfer-Encoding": "chunked"})
+	if err != nil {
+		t.Fatalf("Expected a body of exactly MaxRequestBodyBytes to be accepted, got error: %v", err)
+	}
+	if data, err := io.ReadAll(body); err != nil || string(data) != "abcd" {
+		t.Fatalf("Expected body %q, got %q (err=%v)", "abcd", data, err)
 	}
 
-	err := writeResponse(conn, res)
-	if err != nil {
+	reader = bufio.NewReader(strings.NewReader("5\r\nabcde\r\n0\r\n\r\n"))
+	if _, err := srv.readBody(reader, map[string]string{"Transfer-Encoding": "chunked"}); !errors.Is(err, errBodyTooLarge) {
+		t.Fatalf("Expected an over-limit chunked body to be rejected up front with errBodyTooLarge, got: %v", err)
+	}
+}
+
+// TestReadBodyRejectsNegativeContentLength guards against a regression
+// where strconv.ParseInt happily parsed a negative Content-Length, and
+// io.LimitReader(reader, length) silently turned it into an empty body
+// instead of a 400.
+func TestReadBodyRejectsNegativeContentLength(t *testing.T) {
+	srv := NewServer("")
+	reader := bufio.NewReader(strings.NewReader("ignored"))
+	if _, err := srv.readBody(reader, map[string]string{"Content-Length": "-5"}); err == nil {
+		t.Fatal("Expected a negative Content-Length to be rejected, got no error")
+	}
+}
+
+func TestConnResponseWriter(t *testing.T) {
+	conn := &mockConn{writer: &strings.Builder{}}
+	w := newConnResponseWriter(conn)
+	w.Header()["Content-Type"] = "text/plain"
+	w.Header()["Content-Length"] = "10"
+	w.WriteHeader(200)
+	w.Write([]byte("Hello, Go!"))
+	if err := w.finish(); err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
@@ -49,6 +84,24 @@ func TestWriteResponse(t *testing.T) {
 	}
 }
 
+func TestResponseRecorder(t *testing.T) {
+	rec := NewRecorder()
+	req := &Request{
+		Method:  "GET",
+		URL:     "/hello",
+		Headers: map[string]string{"Name": "Go"},
+	}
+
+	router.ServeRequest(rec, req)
+
+	if rec.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.StatusCode)
+	}
+	if rec.Body.String() != "Hello, Go!" {
+		t.Fatalf("Unexpected body: %q", rec.Body.String())
+	}
+}
+
 type mockConn struct {
 	reader io.Reader
 	writer io.Writer
@@ -87,19 +140,23 @@ func (m *mockConn) SetWriteDeadline(t time.Time) error {
 }
 
 func TestServer(t *testing.T) {
-	go main()
+	ts, err := NewLocalServer(router.ServeRequest)
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer ts.Close()
 
 	tests := []struct {
 		request  string
-		expected string
+		expected []string
 	}{
-		{"GET / HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\n"},
-		{"GET /hello HTTP/1.1\r\nName: Go\r\n\r\n", "HTTP/1.1 200 OK\r\nHello, Go!"},
-		{"GET /notfound HTTP/1.1\r\n\r\n", "HTTP/1.1 404 Not Found\r\n"},
+		{"GET / HTTP/1.1\r\nConnection: close\r\n\r\n", []string{"HTTP/1.1 200 OK\r\n"}},
+		{"GET /hello HTTP/1.1\r\nName: Go\r\nConnection: close\r\n\r\n", []string{"HTTP/1.1 200 OK\r\n", "Hello, Go!"}},
+		{"GET /notfound HTTP/1.1\r\nConnection: close\r\n\r\n", []string{"HTTP/1.1 404 Not Found\r\n"}},
 	}
 
 	for _, test := range tests {
-		conn, err := net.Dial("tcp", "localhost:8080")
+		conn, err := net.Dial("tcp", ts.Addr)
 		if err != nil {
 			t.Fatalf("Failed to connect: %v", err)
 		}
@@ -114,10 +171,83 @@ func TestServer(t *testing.T) {
 			t.Fatalf("Failed to read response: %v", err)
 		}
 
-		if !strings.Contains(string(response), test.expected) {
-			t.Fatalf("Unexpected response: %s", response)
+		for _, want := range test.expected {
+			if !strings.Contains(string(response), want) {
+				t.Fatalf("Expected response to contain %q, got: %s", want, response)
+			}
 		}
 
 		conn.Close()
 	}
 }
+
+// TestLocalServerServesCustomHandler guards against a regression where
+// LocalServer always dispatched through the package-level router instead of
+// a caller-supplied handler.
+func TestLocalServerServesCustomHandler(t *testing.T) {
+	ts, err := NewLocalServer(func(w ResponseWriter, req *Request) {
+		w.Header()["Content-Type"] = "text/plain"
+		w.WriteHeader(200)
+		w.Write([]byte("custom handler"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer ts.Close()
+
+	if !strings.HasPrefix(ts.URL, "http://") {
+		t.Fatalf("Expected URL to have an http:// scheme, got %q", ts.URL)
+	}
+
+	conn, err := net.Dial("tcp", ts.Addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !strings.Contains(string(response), "custom handler") {
+		t.Fatalf("Expected response to contain %q, got: %s", "custom handler", response)
+	}
+}
+
+// TestKeepAliveDrainsUnreadBody guards against a regression where a
+// handler (like handleRoot) that never reads req.Body left its bytes
+// sitting in the connection's shared reader, corrupting the parse of the
+// next pipelined request on the same keep-alive connection.
+func TestKeepAliveDrainsUnreadBody(t *testing.T) {
+	ts, err := NewLocalServer(router.ServeRequest)
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	request := "GET / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /hello HTTP/1.1\r\nName: Go\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	responses := strings.Split(string(response), "HTTP/1.1 ")
+	if len(responses) != 3 || !strings.HasPrefix(responses[1], "200") || !strings.Contains(responses[2], "Hello, Go!") {
+		t.Fatalf("Expected two 200 responses with the second containing %q, got: %s", "Hello, Go!", response)
+	}
+}
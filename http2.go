@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http2Preface is the connection preface an HTTP/2 client sends immediately
+// after ALPN negotiates "h2", before the first frame.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types and flags this server understands (RFC 7540 §6, §11.2).
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1 // SETTINGS, PING
+	flagEndHeaders = 0x4
+)
+
+// http2FrameHeader is the common 9-byte header prefixing every HTTP/2 frame.
+type http2FrameHeader struct {
+	Length   uint32 // 24-bit
+	Type     byte
+	Flags    byte
+	StreamID uint32 // 31-bit
+}
+
+// http2Stream accumulates a single stream's HEADERS (+ CONTINUATION) and
+// DATA frames until they're complete enough to dispatch through the router.
+// A stream is ready to dispatch once its header block is complete
+// (END_HEADERS) and the client has signaled it has no more frames to send
+// for this stream (END_STREAM, on the HEADERS frame for a bodyless request
+// or on the final DATA frame otherwise) — not merely once headers are done,
+// since a request with a body still has DATA frames in flight at that point.
+type http2Stream struct {
+	id          uint32
+	headerBlock []byte
+	body        []byte
+	endHeaders  bool
+	endStream   bool
+}
+
+func (s *http2Stream) ready() bool { return s.endHeaders && s.endStream }
+
+// http2Conn serializes frame writes to a connection. The main read loop acks
+// SETTINGS/PING frames while per-stream goroutines (one per dispatched
+// handleHTTP2Stream call) write HEADERS/DATA frames for their responses
+// concurrently, and net.Conn.Write is not safe for concurrent use, so every
+// write goes through writeFrame rather than the connection directly.
+type http2Conn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *http2Conn) writeFrame(typ, flags byte, streamID uint32, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeHTTP2Frame(c.Conn, typ, flags, streamID, payload)
+}
+
+// serveHTTP2 serves a single TLS connection that has already ALPN-negotiated
+// "h2". It implements just enough of RFC 7540 to translate simple
+// request/response exchanges into the same Request and ResponseWriter types
+// the HTTP/1.1 path uses: SETTINGS (acked, otherwise ignored), PING (acked),
+// HEADERS/CONTINUATION (decoded via a static-table-only HPACK subset with no
+// Huffman support), DATA, WINDOW_UPDATE (ignored — this server does not
+// implement flow control), and GOAWAY.
+func serveHTTP2(conn net.Conn) {
+	defer conn.Close()
+	hc := &http2Conn{Conn: conn}
+	reader := bufio.NewReader(conn)
+
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(reader, preface); err != nil || string(preface) != http2Preface {
+		log.Printf("invalid HTTP/2 connection preface")
+		return
+	}
+
+	if err := hc.writeFrame(frameSettings, 0, 0, nil); err != nil {
+		log.Printf("Error writing initial SETTINGS frame: %v", err)
+		return
+	}
+
+	streams := make(map[uint32]*http2Stream)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout))
+		fh, err := readHTTP2FrameHeader(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading HTTP/2 frame header: %v", err)
+			}
+			return
+		}
+
+		payload := make([]byte, fh.Length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Printf("Error reading HTTP/2 frame payload: %v", err)
+			return
+		}
+
+		switch fh.Type {
+		case frameSettings:
+			if fh.Flags&flagAck == 0 {
+				if err := hc.writeFrame(frameSettings, flagAck, 0, nil); err != nil {
+					return
+				}
+			}
+
+		case framePing:
+			if fh.Flags&flagAck == 0 {
+				if err := hc.writeFrame(framePing, flagAck, 0, payload); err != nil {
+					return
+				}
+			}
+
+		case frameWindowUpdate, framePriority:
+			// No flow control or stream prioritization: nothing to do.
+
+		case frameHeaders, frameContinuation:
+			stream := streams[fh.StreamID]
+			if stream == nil {
+				stream = &http2Stream{id: fh.StreamID}
+				streams[fh.StreamID] = stream
+			}
+			stream.headerBlock = append(stream.headerBlock, payload...)
+			if fh.Flags&flagEndHeaders != 0 {
+				stream.endHeaders = true
+			}
+			if fh.Type == frameHeaders && fh.Flags&flagEndStream != 0 {
+				stream.endStream = true
+			}
+			if stream.ready() {
+				delete(streams, fh.StreamID)
+				go handleHTTP2Stream(hc, stream)
+			}
+
+		case frameData:
+			stream := streams[fh.StreamID]
+			if stream != nil {
+				stream.body = append(stream.body, payload...)
+				if fh.Flags&flagEndStream != 0 {
+					stream.endStream = true
+				}
+				if stream.ready() {
+					delete(streams, fh.StreamID)
+					go handleHTTP2Stream(hc, stream)
+				}
+			}
+
+		case frameGoAway:
+			return
+		}
+	}
+}
+
+// handleHTTP2Stream decodes a complete HEADERS block, builds the same
+// Request type the HTTP/1.1 path uses, dispatches it through the router, and
+// writes back the response as HEADERS (+ DATA) frames.
+func handleHTTP2Stream(hc *http2Conn, stream *http2Stream) {
+	headers, err := decodeHeaderBlock(stream.headerBlock)
+	if err != nil {
+		log.Printf("Error decoding HTTP/2 headers: %v", err)
+		hc.writeFrame(frameRSTStream, 0, stream.id, []byte{0, 0, 0, 1}) // PROTOCOL_ERROR
+		return
+	}
+
+	req := &Request{
+		Method:  headers[":method"],
+		URL:     headers[":path"],
+		Proto:   "HTTP/2.0",
+		Headers: headers,
+		Body:    &body{Reader: bytes.NewReader(stream.body)},
+	}
+	delete(req.Headers, ":method")
+	delete(req.Headers, ":path")
+	delete(req.Headers, ":scheme")
+	delete(req.Headers, ":authority")
+
+	w := newHTTP2ResponseWriter(hc, stream.id)
+	router.ServeRequest(w, req)
+	if err := w.finish(); err != nil {
+		log.Printf("Error writing HTTP/2 response: %v", err)
+	}
+}
+
+// http2ResponseWriter is the ResponseWriter a single HTTP/2 stream is served
+// through: WriteHeader only records the status, the first Write flushes a
+// HEADERS frame carrying it, and each Write's bytes become their own DATA
+// frame. finish
+// terminates the stream, sending END_STREAM on the HEADERS frame if no body
+// was ever written, or on a trailing empty DATA frame otherwise.
+type http2ResponseWriter struct {
+	conn        *http2Conn
+	streamID    uint32
+	headers     map[string]string
+	statusCode  int
+	wroteHeader bool
+	headersSent bool
+	err         error
+}
+
+func newHTTP2ResponseWriter(conn *http2Conn, streamID uint32) *http2ResponseWriter {
+	return &http2ResponseWriter{conn: conn, streamID: streamID, headers: make(map[string]string), statusCode: 200}
+}
+
+func (w *http2ResponseWriter) Header() map[string]string { return w.headers }
+
+func (w *http2ResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+}
+
+func (w *http2ResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.headersSent {
+		if err := w.sendHeaders(flagEndHeaders); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.conn.writeFrame(frameData, 0, w.streamID, p); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *http2ResponseWriter) sendHeaders(flags byte) error {
+	w.headersSent = true
+	fields := [][2]string{{":status", strconv.Itoa(w.statusCode)}}
+	for k, v := range w.headers {
+		fields = append(fields, [2]string{strings.ToLower(k), v})
+	}
+	return w.conn.writeFrame(frameHeaders, flags, w.streamID, encodeHeaderBlock(fields))
+}
+
+// finish flushes a response that never called Write (sending an empty
+// END_STREAM HEADERS frame) and otherwise terminates the stream's body with
+// a trailing empty END_STREAM DATA frame.
+func (w *http2ResponseWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if !w.headersSent {
+		return w.sendHeaders(flagEndHeaders | flagEndStream)
+	}
+	return w.conn.writeFrame(frameData, flagEndStream, w.streamID, nil)
+}
+
+func readHTTP2FrameHeader(r io.Reader) (http2FrameHeader, error) {
+	var buf [9]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return http2FrameHeader{}, err
+	}
+	return http2FrameHeader{
+		Length:   uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2]),
+		Type:     buf[3],
+		Flags:    buf[4],
+		StreamID: binary.BigEndian.Uint32(buf[5:9]) &^ (1 << 31),
+	}, nil
+}
+
+func writeHTTP2Frame(w io.Writer, typ, flags byte, streamID uint32, payload []byte) error {
+	var header [9]byte
+	header[0] = byte(len(payload) >> 16)
+	header[1] = byte(len(payload) >> 8)
+	header[2] = byte(len(payload))
+	header[3] = typ
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], streamID)
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// hpackStaticEntry is one row of the fixed 61-entry HPACK static table
+// (RFC 7541 Appendix A).
+type hpackStaticEntry struct {
+	name  string
+	value string
+}
+
+var hpackStaticTable = map[uint64]hpackStaticEntry{
+	1: {":authority", ""}, 2: {":method", "GET"}, 3: {":method", "POST"},
+	4: {":path", "/"}, 5: {":path", "/index.html"}, 6: {":scheme", "http"},
+	7: {":scheme", "https"}, 8: {":status", "200"}, 9: {":status", "204"},
+	10: {":status", "206"}, 11: {":status", "304"}, 12: {":status", "400"},
+	13: {":status", "404"}, 14: {":status", "500"}, 15: {"accept-charset", ""},
+	16: {"accept-encoding", "gzip, deflate"}, 17: {"accept-language", ""},
+	18: {"accept-ranges", ""}, 19: {"accept", ""}, 20: {"access-control-allow-origin", ""},
+	21: {"age", ""}, 22: {"allow", ""}, 23: {"authorization", ""},
+	24: {"cache-control", ""}, 25: {"content-disposition", ""}, 26: {"content-encoding", ""},
+	27: {"content-language", ""}, 28: {"content-length", ""}, 29: {"content-location", ""},
+	30: {"content-range", ""}, 31: {"content-type", ""}, 32: {"cookie", ""},
+	33: {"date", ""}, 34: {"etag", ""}, 35: {"expect", ""}, 36: {"expires", ""},
+	37: {"from", ""}, 38: {"host", ""}, 39: {"if-match", ""}, 40: {"if-modified-since", ""},
+	41: {"if-none-match", ""}, 42: {"if-range", ""}, 43: {"if-unmodified-since", ""},
+	44: {"last-modified", ""}, 45: {"link", ""}, 46: {"location", ""},
+	47: {"max-forwards", ""}, 48: {"proxy-authenticate", ""}, 49: {"proxy-authorization", ""},
+	50: {"range", ""}, 51: {"referer", ""}, 52: {"refresh", ""}, 53: {"retry-after", ""},
+	54: {"server", ""}, 55: {"set-cookie", ""}, 56: {"strict-transport-security", ""},
+	57: {"transfer-encoding", ""}, 58: {"user-agent", ""}, 59: {"vary", ""},
+	60: {"via", ""}, 61: {"www-authenticate", ""},
+}
+
+// decodeHeaderBlock decodes an HPACK header block into a plain header map.
+// It supports indexed header fields and literal header fields (both with
+// and without indexing) looked up or named via the static table, which
+// covers the common pseudo-headers and request headers; it does not
+// maintain a dynamic table or decode Huffman-coded strings, so it is only
+// suitable for simple, uncompressed requests.
+func decodeHeaderBlock(block []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed header field
+			idx, n, err := decodeHPACKInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			entry, ok := hpackStaticTable[idx]
+			if !ok {
+				return nil, fmt.Errorf("unsupported HPACK index %d", idx)
+			}
+			headers[entry.name] = entry.value
+			block = block[n:]
+
+		case b&0xc0 == 0x40, b&0xf0 == 0x00, b&0xf0 == 0x10: // literal header field
+			prefixBits := 4
+			if b&0xc0 == 0x40 {
+				prefixBits = 6
+			}
+			idx, n, err := decodeHPACKInt(block, prefixBits)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+
+			name := ""
+			if idx != 0 {
+				entry, ok := hpackStaticTable[idx]
+				if !ok {
+					return nil, fmt.Errorf("unsupported HPACK index %d", idx)
+				}
+				name = entry.name
+			} else {
+				decoded, consumed, err := decodeHPACKString(block)
+				if err != nil {
+					return nil, err
+				}
+				name = decoded
+				block = block[consumed:]
+			}
+
+			value, consumed, err := decodeHPACKString(block)
+			if err != nil {
+				return nil, err
+			}
+			block = block[consumed:]
+			headers[name] = value
+
+		default:
+			return nil, fmt.Errorf("unsupported HPACK representation 0x%02x", b)
+		}
+	}
+	return headers, nil
+}
+
+// decodeHPACKInt decodes an RFC 7541 §5.1 prefixed integer with the given
+// prefix width, returning the value and the number of bytes consumed.
+func decodeHPACKInt(p []byte, prefixBits int) (uint64, int, error) {
+	if len(p) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	mask := byte(1<<uint(prefixBits) - 1)
+	value := uint64(p[0] & mask)
+	if value < uint64(mask) {
+		return value, 1, nil
+	}
+
+	shift := uint(0)
+	for i := 1; ; i++ {
+		if i >= len(p) {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		value += uint64(p[i]&0x7f) << shift
+		if p[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+	}
+}
+
+// decodeHPACKString decodes an RFC 7541 §5.2 string literal. Huffman-coded
+// strings are rejected (see decodeHeaderBlock's doc comment).
+func decodeHPACKString(p []byte) (string, int, error) {
+	if len(p) == 0 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	if p[0]&0x80 != 0 {
+		return "", 0, fmt.Errorf("huffman-encoded HPACK strings are not supported")
+	}
+	length, n, err := decodeHPACKInt(p, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	end := n + int(length)
+	if end > len(p) {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	return string(p[n:end]), end, nil
+}
+
+// encodeHeaderBlock encodes fields as HPACK literal header fields without
+// indexing and without Huffman coding, which is correct (if not maximally
+// compact) for any peer that can decode HPACK.
+func encodeHeaderBlock(fields [][2]string) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteByte(0x00) // literal header field without indexing, new name
+		encodeHPACKString(&buf, f[0])
+		encodeHPACKString(&buf, f[1])
+	}
+	return buf.Bytes()
+}
+
+func encodeHPACKString(buf *bytes.Buffer, s string) {
+	encodeHPACKInt(buf, 7, 0x00, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func encodeHPACKInt(buf *bytes.Buffer, prefixBits int, prefixFlags byte, v uint64) {
+	max := uint64(1<<uint(prefixBits) - 1)
+	if v < max {
+		buf.WriteByte(prefixFlags | byte(v))
+		return
+	}
+	buf.WriteByte(prefixFlags | byte(max))
+	v -= max
+	for v >= 0x80 {
+		buf.WriteByte(byte(v&0x7f) | 0x80)
+		v >>= 7
+	}
+	buf.WriteByte(byte(v))
+}
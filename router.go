@@ -0,0 +1,206 @@
+package main
+
+import "strings"
+
+// HandlerFunc handles a single request, writing its response to w.
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// Middleware wraps a HandlerFunc to add cross-cutting behavior (logging,
+// gzip, auth, ...). Middlewares run in the order they are registered with
+// Router.Use, outermost first.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Router dispatches requests to handlers registered with Handle, matching
+// both the path (including path parameters and wildcards) and the method.
+// Each HTTP method gets its own routing trie, so lookup cost is proportional
+// to the number of path segments rather than the number of registered
+// routes.
+type Router struct {
+	trees      map[string]*routeNode
+	middleware []Middleware
+}
+
+// NewRouter returns an empty Router ready for route registration.
+func NewRouter() *Router {
+	return &Router{trees: make(map[string]*routeNode)}
+}
+
+// Use appends mw to the middleware chain applied to every request dispatched
+// through this router.
+func (r *Router) Use(mw Middleware) {
+	r.middleware = append(r.middleware, mw)
+}
+
+// Handle registers h to serve method requests matching pattern. pattern
+// segments starting with ":" bind a path parameter (e.g. "/users/:id"
+// matches "/users/42" with Params["id"] == "42"); a segment starting with
+// "*" binds the remainder of the path (e.g. "/static/*path").
+func (r *Router) Handle(method, pattern string, h HandlerFunc) {
+	root, ok := r.trees[method]
+	if !ok {
+		root = &routeNode{}
+		r.trees[method] = root
+	}
+	root.insert(splitPath(pattern), nil, h)
+}
+
+// ServeRequest routes req to its registered handler, running it through the
+// middleware chain. If the path matches a registered route but not for
+// req.Method, it writes 405 with an Allow header listing the methods that
+// do match. If the path matches no route at all, it writes 404.
+func (r *Router) ServeRequest(w ResponseWriter, req *Request) {
+	path := req.URL
+	if idx := strings.IndexByte(path, '?'); idx >= 0 {
+		path = path[:idx]
+	}
+	segments := splitPath(path)
+
+	if root, ok := r.trees[req.Method]; ok {
+		if h, names, values, ok := root.search(segments, nil); ok {
+			req.Params = zipParams(names, values)
+			r.chain(h)(w, req)
+			return
+		}
+	}
+
+	if allowed := r.allowedMethods(segments); len(allowed) > 0 {
+		w.Header()["Content-Type"] = "text/plain"
+		w.Header()["Allow"] = strings.Join(allowed, ", ")
+		w.WriteHeader(405)
+		w.Write([]byte("405 Method Not Allowed"))
+		return
+	}
+
+	w.Header()["Content-Type"] = "text/plain"
+	w.WriteHeader(404)
+	w.Write([]byte("404 Not Found"))
+}
+
+// allowedMethods returns the methods, if any, with a route registered for
+// segments, for building the Allow header on a 405 response.
+func (r *Router) allowedMethods(segments []string) []string {
+	var allowed []string
+	for method, root := range r.trees {
+		if _, _, _, ok := root.search(segments, nil); ok {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// zipParams pairs names (the path-parameter names of whichever route
+// matched, in positional order) with values (the segments captured at those
+// positions during search), or returns nil if the route took no parameters.
+func zipParams(names, values []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	params := make(map[string]string, len(names))
+	for i, name := range names {
+		params[name] = values[i]
+	}
+	return params
+}
+
+// chain wraps h with the router's middleware, outermost-registered first.
+func (r *Router) chain(h HandlerFunc) HandlerFunc {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h
+}
+
+// routeNode is one segment's worth of a method's routing trie. A single
+// paramChild/wildcardChild is shared by every route that has a parameter at
+// that position, so the parameter's name can't live on the shared node
+// itself (two routes sharing a prefix, e.g. "/a/:id" and "/a/:slug/edit",
+// would then fight over it). Instead each terminal node remembers the
+// ordered list of parameter names for the specific route registered there,
+// and search carries the matched values back up to be zipped with that list
+// once a handler is found.
+type routeNode struct {
+	children map[string]*routeNode
+
+	paramChild    *routeNode
+	wildcardChild *routeNode
+
+	handler    HandlerFunc
+	paramNames []string
+}
+
+func (n *routeNode) insert(segments []string, paramNames []string, h HandlerFunc) {
+	if len(segments) == 0 {
+		n.handler = h
+		n.paramNames = paramNames
+		return
+	}
+
+	seg := segments[0]
+	switch {
+	case strings.HasPrefix(seg, ":"):
+		if n.paramChild == nil {
+			n.paramChild = &routeNode{}
+		}
+		n.paramChild.insert(segments[1:], append(paramNames, seg[1:]), h)
+	case strings.HasPrefix(seg, "*"):
+		if n.wildcardChild == nil {
+			n.wildcardChild = &routeNode{}
+		}
+		n.wildcardChild.handler = h
+		n.wildcardChild.paramNames = append(paramNames, seg[1:])
+	default:
+		if n.children == nil {
+			n.children = make(map[string]*routeNode)
+		}
+		child, ok := n.children[seg]
+		if !ok {
+			child = &routeNode{}
+			n.children[seg] = child
+		}
+		child.insert(segments[1:], paramNames, h)
+	}
+}
+
+// search walks segments looking for a matching route, threading values (the
+// path-parameter values captured so far, in positional order) down the
+// recursion. On a match it returns the handler, its paramNames, and the
+// values to zip them with; the caller does the zipping since a node along
+// the way doesn't know whether the route that ultimately matches even takes
+// parameters.
+func (n *routeNode) search(segments []string, values []string) (HandlerFunc, []string, []string, bool) {
+	if len(segments) == 0 {
+		return n.handler, n.paramNames, values, n.handler != nil
+	}
+
+	seg := segments[0]
+	if n.children != nil {
+		if child, ok := n.children[seg]; ok {
+			if h, names, vals, ok := child.search(segments[1:], values); ok {
+				return h, names, vals, true
+			}
+		}
+	}
+
+	if n.paramChild != nil {
+		if h, names, vals, ok := n.paramChild.search(segments[1:], append(values, seg)); ok {
+			return h, names, vals, true
+		}
+	}
+
+	if n.wildcardChild != nil && n.wildcardChild.handler != nil {
+		vals := append(values, strings.Join(segments, "/"))
+		return n.wildcardChild.handler, n.wildcardChild.paramNames, vals, true
+	}
+
+	return nil, nil, nil, false
+}
+
+// splitPath splits an URL path into its non-empty segments, so "/" and ""
+// both yield no segments, and "/users/" splits the same way as "/users".
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestServeRequestStripsQueryString(t *testing.T) {
+	rec := NewRecorder()
+	req := &Request{Method: "GET", URL: "/hello?name=Go"}
+
+	router.ServeRequest(rec, req)
+
+	if rec.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.StatusCode)
+	}
+}
+
+// TestRouterParamNamesDontLeakBetweenSiblingRoutes guards against a
+// regression where two routes sharing a path-parameter position, but naming
+// it differently, clobbered each other's name: registering "/a/:slug/edit"
+// after "/a/:id" made a request to "/a/42" report Params["slug"] instead of
+// Params["id"], because the name was stored on the shared parent node
+// rather than per-route.
+func TestRouterParamNamesDontLeakBetweenSiblingRoutes(t *testing.T) {
+	r := NewRouter()
+	var gotID, gotSlug map[string]string
+	r.Handle("GET", "/a/:id", func(w ResponseWriter, req *Request) { gotID = req.Params })
+	r.Handle("GET", "/a/:slug/edit", func(w ResponseWriter, req *Request) { gotSlug = req.Params })
+
+	r.ServeRequest(NewRecorder(), &Request{Method: "GET", URL: "/a/42"})
+	if gotID["id"] != "42" {
+		t.Fatalf("Expected Params[%q] = %q, got %+v", "id", "42", gotID)
+	}
+
+	r.ServeRequest(NewRecorder(), &Request{Method: "GET", URL: "/a/43/edit"})
+	if gotSlug["slug"] != "43" {
+		t.Fatalf("Expected Params[%q] = %q, got %+v", "slug", "43", gotSlug)
+	}
+}
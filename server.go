@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+)
+
+// Server configures and runs the listener loop, optionally over TLS. It
+// replaces the bare net.Listen call main used to make directly, so that
+// listener setup (and its TLS/ALPN variant) is reusable outside main.
+type Server struct {
+	// Addr is the TCP address to listen on, e.g. ":8080".
+	Addr string
+
+	// TLSConfig is used as the base configuration for ListenAndServeTLS.
+	// Its Certificates and NextProtos are filled in from the certFile/keyFile
+	// arguments and the h2/http1.1 ALPN protocol list respectively; callers
+	// only need to set it to customize things like MinVersion or ClientAuth.
+	TLSConfig *tls.Config
+
+	// MaxRequestBodyBytes bounds how large an HTTP/1.1 request body this
+	// server will accept before responding 413. NewServer sets it to
+	// defaultMaxRequestBodyBytes; callers can tune it per Server afterward.
+	// HTTP/2 request bodies are not bounded by it.
+	MaxRequestBodyBytes int64
+
+	// Handler serves each HTTP/1.1 request this Server accepts. It defaults
+	// to nil, in which case handleConnection dispatches through the
+	// package-level router; LocalServer (httptest.go) sets it to serve a
+	// caller-supplied handler instead. HTTP/2 streams always dispatch through
+	// the package-level router, whatever Handler is set to.
+	Handler HandlerFunc
+}
+
+// NewServer returns a Server listening on addr.
+func NewServer(addr string) *Server {
+	return &Server{Addr: addr, MaxRequestBodyBytes: defaultMaxRequestBodyBytes}
+}
+
+// ListenAndServe listens for plain HTTP/1.1 connections on s.Addr.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// ListenAndServeTLS listens for TLS connections on s.Addr, using certFile
+// and keyFile for the server certificate. It advertises "h2" and "http/1.1"
+// via ALPN, appending whichever of them is missing after any protocols
+// already in TLSConfig.NextProtos (so by default "h2" comes first);
+// connections that negotiate "h2" are served over
+// HTTP/2, everything else falls through to the HTTP/1.1 code path.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := s.TLSConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	tlsConfig.NextProtos = withDefaultProtos(tlsConfig.NextProtos)
+
+	listener, err := tls.Listen("tcp", s.Addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// withDefaultProtos ensures "h2" and "http/1.1" are both advertised, without
+// dropping any protocols the caller already configured.
+func withDefaultProtos(protos []string) []string {
+	have := map[string]bool{}
+	for _, p := range protos {
+		have[p] = true
+	}
+	for _, want := range []string{"h2", "http/1.1"} {
+		if !have[want] {
+			protos = append(protos, want)
+		}
+	}
+	return protos
+}
+
+// Serve accepts connections off listener until it returns an error, handling
+// each one in its own goroutine.
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn completes the TLS handshake (if any) and routes the connection
+// to the HTTP/2 or HTTP/1.1 code path based on the ALPN-negotiated protocol.
+func (s *Server) handleConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error: %v", err)
+			conn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			serveHTTP2(tlsConn)
+			return
+		}
+	}
+	s.handleConnection(conn)
+}